@@ -0,0 +1,137 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// A Backend is a place the keychain's bytes (plaintext or, once encrypted,
+// the encrypted form) can be stored and loaded from. The default is the
+// local file $HOME/.2fa; 2FA_BACKEND selects one of the others registered
+// by the platform-specific files in this package.
+type Backend interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// errNotExist is returned by Load when the backend has nothing stored yet,
+// the Backend analogue of os.IsNotExist.
+var errNotExist = errors.New("keychain not found")
+
+// backendConstructors holds the backends available on this platform,
+// keyed by the name used in 2FA_BACKEND. The file and pass backends work
+// everywhere; the platform-specific *_darwin.go, *_windows.go and
+// *_linux.go files register the OS-native ones from their init functions.
+var backendConstructors = map[string]func(file string) Backend{
+	"file": func(file string) Backend { return &fileBackend{path: file} },
+	"pass": func(file string) Backend { return &passBackend{entry: "2fa/keychain"} },
+}
+
+// newBackend picks the Backend named by $2FA_BACKEND, defaulting to the
+// plaintext (or, if encrypted, self-encrypting) file at file.
+func newBackend(file string) Backend {
+	name := os.Getenv("2FA_BACKEND")
+	if name == "" {
+		name = "file"
+	}
+	ctor, ok := backendConstructors[name]
+	if !ok {
+		log.Fatalf("unknown or unsupported 2FA_BACKEND %q", name)
+	}
+	return ctor(file)
+}
+
+// fileBackend is the original backend: the keychain lives in a single
+// file on disk, written out with a rename so a crash never truncates it.
+type fileBackend struct {
+	path string
+}
+
+func (b *fileBackend) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNotExist
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *fileBackend) Save(data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Chmod(0600)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// passBackend stores the keychain in the pass(1) password store, under
+// entry, base64-encoded since pass entries are line-oriented text.
+type passBackend struct {
+	entry string
+}
+
+func (b *passBackend) Load() ([]byte, error) {
+	out, err := exec.Command("pass", "show", b.entry).Output()
+	if err != nil {
+		if isPassNotFound(err) {
+			return nil, errNotExist
+		}
+		return nil, err
+	}
+	return decodeBlob(out)
+}
+
+func (b *passBackend) Save(data []byte) error {
+	cmd := exec.Command("pass", "insert", "-f", "-m", b.entry)
+	cmd.Stdin = bytes.NewReader(encodeBlob(data))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(string(out))
+	}
+	return nil
+}
+
+func isPassNotFound(err error) bool {
+	ee, ok := err.(*exec.ExitError)
+	return ok && bytes.Contains(ee.Stderr, []byte("is not in the password store"))
+}
+
+// encodeBlob and decodeBlob let backends that expect printable text
+// (pass, and the command-line OS keystores) carry the keychain's raw
+// bytes, which may be binary once the keychain is encrypted.
+func encodeBlob(data []byte) []byte {
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(data))+1)
+	base64.StdEncoding.Encode(enc, data)
+	enc[len(enc)-1] = '\n'
+	return enc
+}
+
+func decodeBlob(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+func init() {
+	backendConstructors["secret-service"] = func(string) Backend { return &secretServiceBackend{} }
+}
+
+// secretServiceBackend stores the keychain as a single item in the
+// default collection of the org.freedesktop.secrets D-Bus service.
+// Both GNOME Keyring and KWallet implement this same API, so this one
+// backend covers both desktops.
+type secretServiceBackend struct{}
+
+const (
+	secretServiceDest = "org.freedesktop.secrets"
+	secretServicePath = "/org/freedesktop/secrets"
+	defaultCollection = "/org/freedesktop/secrets/aliases/default"
+)
+
+var secretAttrs = map[string]string{"application": "2fa"}
+
+// secret mirrors the Secret Service "Secret" D-Bus struct.
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+func secretServiceSession() (*dbus.Conn, dbus.ObjectPath, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, "", err
+	}
+	svc := conn.Object(secretServiceDest, secretServicePath)
+	var out dbus.Variant
+	var session dbus.ObjectPath
+	if err := svc.Call("org.freedesktop.Secret.Service.OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&out, &session); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, session, nil
+}
+
+func (b *secretServiceBackend) Load() ([]byte, error) {
+	conn, session, err := secretServiceSession()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	svc := conn.Object(secretServiceDest, secretServicePath)
+	var unlocked, locked []dbus.ObjectPath
+	if err := svc.Call("org.freedesktop.Secret.Service.SearchItems", 0, secretAttrs).Store(&unlocked, &locked); err != nil {
+		return nil, err
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		var prompt dbus.ObjectPath
+		if err := svc.Call("org.freedesktop.Secret.Service.Unlock", 0, locked).Store(&unlocked, &prompt); err != nil {
+			return nil, err
+		}
+	}
+	if len(unlocked) == 0 {
+		return nil, errNotExist
+	}
+
+	item := conn.Object(secretServiceDest, unlocked[0])
+	var sec secret
+	if err := item.Call("org.freedesktop.Secret.Item.GetSecret", 0, session).Store(&sec); err != nil {
+		return nil, err
+	}
+	return sec.Value, nil
+}
+
+func (b *secretServiceBackend) Save(data []byte) error {
+	conn, session, err := secretServiceSession()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	props := map[string]dbus.Variant{
+		"org.freedesktop.Secret.Item.Label":      dbus.MakeVariant("2fa keychain"),
+		"org.freedesktop.Secret.Item.Attributes": dbus.MakeVariant(secretAttrs),
+	}
+	sec := secret{Session: session, Parameters: []byte{}, Value: data, ContentType: "application/octet-stream"}
+
+	coll := conn.Object(secretServiceDest, dbus.ObjectPath(defaultCollection))
+	var item, prompt dbus.ObjectPath
+	return coll.Call("org.freedesktop.Secret.Collection.CreateItem", 0, props, sec, true).Store(&item, &prompt)
+}
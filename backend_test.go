@@ -0,0 +1,127 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestNewBackendDefaultsToFile(t *testing.T) {
+	t.Setenv("2FA_BACKEND", "")
+	b := newBackend(filepath.Join(t.TempDir(), ".2fa"))
+	if _, ok := b.(*fileBackend); !ok {
+		t.Fatalf("newBackend with no $2FA_BACKEND = %T, want *fileBackend", b)
+	}
+}
+
+func TestNewBackendSelectsByName(t *testing.T) {
+	t.Setenv("2FA_BACKEND", "file")
+	if _, ok := newBackend(filepath.Join(t.TempDir(), ".2fa")).(*fileBackend); !ok {
+		t.Error(`newBackend with 2FA_BACKEND=file did not return a *fileBackend`)
+	}
+
+	t.Setenv("2FA_BACKEND", "pass")
+	if _, ok := newBackend(filepath.Join(t.TempDir(), ".2fa")).(*passBackend); !ok {
+		t.Error(`newBackend with 2FA_BACKEND=pass did not return a *passBackend`)
+	}
+}
+
+func TestFileBackendRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".2fa")
+	b := &fileBackend{path: path}
+
+	if _, err := b.Load(); err != errNotExist {
+		t.Fatalf("Load on missing file = %v, want errNotExist", err)
+	}
+
+	want := []byte("github 6 NZXXIIDBEBVWK6JB\n")
+	if err := b.Save(want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	got, err := b.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("Load = %q, want %q", got, want)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("keychain file mode = %o, want 0600", perm)
+	}
+}
+
+// fakePassScript is a shell script standing in for pass(1): it records
+// enough of the real tool's behavior (show/insert, the "not in the
+// password store" error text, and the entry path) for passBackend's
+// Load/Save to be exercised without a real password store.
+const fakePassScript = `#!/bin/sh
+set -e
+store="$FAKE_PASS_STORE"
+case "$1" in
+show)
+	entry="$2"
+	file="$store/$entry"
+	if [ ! -f "$file" ]; then
+		echo "$entry is not in the password store." >&2
+		exit 1
+	fi
+	cat "$file"
+	;;
+insert)
+	# insert -f -m <entry>
+	entry="$4"
+	file="$store/$entry"
+	mkdir -p "$(dirname "$file")"
+	cat > "$file"
+	;;
+*)
+	echo "fake pass: unsupported args: $@" >&2
+	exit 1
+	;;
+esac
+`
+
+func installFakePass(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake pass script requires a POSIX shell")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "pass")
+	if err := os.WriteFile(script, []byte(fakePassScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_PASS_STORE", t.TempDir())
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPassBackendRoundTrip(t *testing.T) {
+	installFakePass(t)
+	b := &passBackend{entry: "2fa/keychain"}
+
+	if _, err := b.Load(); err != errNotExist {
+		t.Fatalf("Load with nothing inserted = %v, want errNotExist", err)
+	}
+
+	want := []byte("github 6 NZXXIIDBEBVWK6JB\n")
+	if err := b.Save(want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	got, err := b.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("Load = %q, want %q", got, want)
+	}
+}
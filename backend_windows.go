@@ -0,0 +1,37 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/danieljoos/wincred"
+)
+
+func init() {
+	backendConstructors["wincred"] = func(string) Backend { return &wincredBackend{} }
+}
+
+// wincredBackend stores the keychain as a generic credential in the
+// Windows Credential Manager.
+type wincredBackend struct{}
+
+const wincredTarget = "2fa/keychain"
+
+func (b *wincredBackend) Load() ([]byte, error) {
+	cred, err := wincred.GetGenericCredential(wincredTarget)
+	if err != nil {
+		if err == wincred.ErrElementNotFound {
+			return nil, errNotExist
+		}
+		return nil, err
+	}
+	return cred.CredentialBlob, nil
+}
+
+func (b *wincredBackend) Save(data []byte) error {
+	cred := wincred.NewGenericCredential(wincredTarget)
+	cred.CredentialBlob = data
+	cred.Persist = wincred.PersistLocalMachine
+	return cred.Write()
+}
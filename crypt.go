@@ -0,0 +1,178 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// The encrypted keychain format starts with a short plaintext header
+// identifying the file as encrypted and recording the scrypt parameters
+// and salt needed to derive the file key, followed by the keychain text
+// encrypted in fixed-size chunks using the STREAM construction described
+// in https://eprint.iacr.org/2015/189 (the same approach age uses).
+var magic = []byte("2fa-encrypted-keychain-v1\n")
+
+const (
+	version1  = 1
+	saltLen   = 16
+	chunkSize = 64 * 1024
+	scryptR   = 8
+	scryptP   = 1
+	defaultN  = 18 // scrypt N = 1<<defaultN
+)
+
+// encryptKeychain encrypts plaintext under a key derived from passphrase
+// and returns the full on-disk representation (header plus ciphertext).
+func encryptKeychain(plaintext, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt, defaultN)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write(magic)
+	out.WriteByte(version1)
+	out.WriteByte(defaultN)
+	out.Write(salt)
+	out.Write(streamSeal(aead, plaintext))
+	return out.Bytes(), nil
+}
+
+// decryptKeychain reverses encryptKeychain, given the full on-disk data.
+func decryptKeychain(data, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, fmt.Errorf("not an encrypted keychain")
+	}
+	rest := data[len(magic):]
+	if len(rest) < 2+saltLen {
+		return nil, fmt.Errorf("encrypted keychain: truncated header")
+	}
+	vers, logN := rest[0], rest[1]
+	if vers != version1 {
+		return nil, fmt.Errorf("encrypted keychain: unsupported version %d", vers)
+	}
+	salt := rest[2 : 2+saltLen]
+	ciphertext := rest[2+saltLen:]
+	aead, err := newAEAD(passphrase, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	return streamOpen(aead, ciphertext)
+}
+
+func newAEAD(passphrase, salt []byte, logN byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// streamSeal splits plaintext into chunkSize chunks and encrypts each one
+// with a nonce formed from an increasing counter and a final-chunk flag,
+// so that truncation or reordering of the ciphertext is detected on open.
+func streamSeal(aead cipher.AEAD, plaintext []byte) []byte {
+	var out bytes.Buffer
+	var nonce [chacha20poly1305.NonceSize]byte
+	var counter uint64
+	for len(plaintext) > chunkSize {
+		setNonce(&nonce, counter, false)
+		out.Write(aead.Seal(nil, nonce[:], plaintext[:chunkSize], nil))
+		plaintext = plaintext[chunkSize:]
+		counter++
+	}
+	setNonce(&nonce, counter, true)
+	out.Write(aead.Seal(nil, nonce[:], plaintext, nil))
+	return out.Bytes()
+}
+
+func streamOpen(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	const sealed = chunkSize + 16 // chacha20poly1305.Overhead
+	var out bytes.Buffer
+	var nonce [chacha20poly1305.NonceSize]byte
+	var counter uint64
+	for len(ciphertext) > sealed {
+		setNonce(&nonce, counter, false)
+		chunk, err := aead.Open(nil, nonce[:], ciphertext[:sealed], nil)
+		if err != nil {
+			return nil, fmt.Errorf("encrypted keychain: %v", err)
+		}
+		out.Write(chunk)
+		ciphertext = ciphertext[sealed:]
+		counter++
+	}
+	setNonce(&nonce, counter, true)
+	chunk, err := aead.Open(nil, nonce[:], ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted keychain: %v", err)
+	}
+	out.Write(chunk)
+	return out.Bytes(), nil
+}
+
+// setNonce fills nonce with an 11-byte big-endian counter followed by a
+// one-byte flag that is 0x01 on the final chunk and 0x00 otherwise.
+func setNonce(nonce *[chacha20poly1305.NonceSize]byte, counter uint64, last bool) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+}
+
+// getPassphrase obtains the keychain passphrase, either from the file
+// descriptor named by $2FA_PASSPHRASE_FD (for scripted use) or by
+// prompting on standard error. If confirm is true (when establishing a
+// new passphrase), the prompt is asked twice and must match.
+func getPassphrase(confirm bool) []byte {
+	if fdStr := os.Getenv("2FA_PASSPHRASE_FD"); fdStr != "" {
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			log.Fatalf("invalid 2FA_PASSPHRASE_FD: %v", err)
+		}
+		data, err := ioutil.ReadAll(os.NewFile(uintptr(fd), "2FA_PASSPHRASE_FD"))
+		if err != nil {
+			log.Fatalf("reading passphrase from fd %d: %v", fd, err)
+		}
+		return bytes.TrimRight(data, "\r\n")
+	}
+
+	pass := readPassphrase("Enter 2fa keychain passphrase: ")
+	if confirm {
+		again := readPassphrase("Confirm 2fa keychain passphrase: ")
+		if !bytes.Equal(pass, again) {
+			log.Fatal("passphrases did not match")
+		}
+	}
+	return pass
+}
+
+func readPassphrase(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatalf("reading passphrase: %v", err)
+	}
+	return pass
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+)
+
+// testAEAD derives an AEAD with a small scrypt N so tests run fast; the
+// KDF cost itself is exercised separately by TestEncryptDecryptKeychain.
+func testAEAD(t *testing.T) cipher.AEAD {
+	t.Helper()
+	aead, err := newAEAD([]byte("hunter2"), bytes.Repeat([]byte{1}, saltLen), 4)
+	if err != nil {
+		t.Fatalf("newAEAD: %v", err)
+	}
+	return aead
+}
+
+func TestStreamSealOpenRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"exactly one chunk", chunkSize},
+		{"one chunk plus one byte", chunkSize + 1},
+		{"several chunks plus a partial one", chunkSize*2 + 123},
+		{"exactly two chunks", chunkSize * 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			aead := testAEAD(t)
+			plaintext := make([]byte, c.size)
+			for i := range plaintext {
+				plaintext[i] = byte(i)
+			}
+			ciphertext := streamSeal(aead, plaintext)
+			got, err := streamOpen(aead, ciphertext)
+			if err != nil {
+				t.Fatalf("streamOpen: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("round trip produced %d bytes, want %d", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestStreamOpenDetectsTruncation(t *testing.T) {
+	aead := testAEAD(t)
+	ciphertext := streamSeal(aead, make([]byte, chunkSize+100))
+	if _, err := streamOpen(aead, ciphertext[:len(ciphertext)-1]); err == nil {
+		t.Fatal("streamOpen accepted truncated ciphertext, want error")
+	}
+}
+
+func TestStreamOpenDetectsReorderedChunks(t *testing.T) {
+	aead := testAEAD(t)
+	const sealed = chunkSize + 16 // chacha20poly1305.Overhead
+	ciphertext := streamSeal(aead, make([]byte, chunkSize*2+100))
+	if len(ciphertext) < 2*sealed {
+		t.Fatalf("test data too short to hold two chunks: %d bytes", len(ciphertext))
+	}
+	// Swap the first two (both interior, non-final) chunks: each decrypts
+	// fine on its own, but the per-chunk counter nonce should still catch
+	// the reordering.
+	swapped := append([]byte{}, ciphertext[sealed:2*sealed]...)
+	swapped = append(swapped, ciphertext[:sealed]...)
+	swapped = append(swapped, ciphertext[2*sealed:]...)
+	if _, err := streamOpen(aead, swapped); err == nil {
+		t.Fatal("streamOpen accepted reordered chunks, want error")
+	}
+}
+
+func TestEncryptDecryptKeychain(t *testing.T) {
+	plaintext := []byte("github 6 NZXXIIDBEBVWK6JB\n")
+	passphrase := []byte("correct horse battery staple")
+
+	data, err := encryptKeychain(plaintext, passphrase)
+	if err != nil {
+		t.Fatalf("encryptKeychain: %v", err)
+	}
+	if !bytes.HasPrefix(data, magic) {
+		t.Fatalf("encrypted keychain missing magic prefix %q", magic)
+	}
+
+	got, err := decryptKeychain(data, passphrase)
+	if err != nil {
+		t.Fatalf("decryptKeychain: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decryptKeychain = %q, want %q", got, plaintext)
+	}
+
+	if _, err := decryptKeychain(data, []byte("wrong passphrase")); err == nil {
+		t.Fatal("decryptKeychain succeeded with the wrong passphrase, want error")
+	}
+}
@@ -6,20 +6,37 @@
 //
 // Usage:
 //
-//	2fa -add [-7] [-8] [-hotp] name
+//	2fa -add [-7] [-8] [-hotp] [-alg SHA1|SHA256|SHA512] [-period N] name
+//	2fa -add -qr file [name]
+//	2fa -export name
+//	2fa -sync [-window N] name
 //	2fa -list
-//	2fa [-clip] name
+//	2fa -encrypt
+//	2fa [-clip] [-window N] name
 //
 // “2fa -add name” adds a new key to the 2fa keychain with the given name.
 // It prints a prompt to standard error and reads a two-factor key from standard input.
 // Two-factor keys are short case-insensitive strings of letters A-Z and digits 2-7.
 //
+// Instead of a raw key, the prompt also accepts an otpauth:// URI of the
+// kind found in a 2FA enrollment QR code, which carries its own digit
+// count, algorithm, and period. “2fa -add -qr file” reads such a URI out
+// of a PNG or JPEG screenshot of the QR code itself rather than prompting;
+// name then comes from the URI unless it is also given on the command line.
+//
 // By default the new key generates time-based (TOTP) authentication codes;
 // the -hotp flag makes the new key generate counter-based (HOTP) codes instead.
 //
 // By default the new key generates 6-digit codes; the -7 and -8 flags select
 // 7- and 8-digit codes instead.
 //
+// By default the new key uses SHA-1 to generate codes on a 30-second time
+// step; the -alg flag selects SHA-256 or SHA-512 instead, and the -period
+// flag selects a different time step, in seconds.
+//
+// “2fa -export name” prints an otpauth:// URI for the named key, so it can
+// be scanned or pasted into another 2fa keychain or authenticator app.
+//
 // “2fa -list” lists the names of all the keys in the keychain.
 //
 // “2fa name” prints a two-factor authentication code from the key with the
@@ -33,7 +50,28 @@
 // the key and the current time, so it is important that the system clock have
 // at least one-minute accuracy.
 //
-// The keychain is stored unencrypted in the text file $HOME/.2fa.
+// If the system clock has drifted more than that, “2fa -sync name” fixes
+// it for a given key: it prompts for a currently valid code from the
+// server and searches nearby time steps to compute a drift offset, which
+// is then stored in the keychain and applied to future codes for that
+// key. The “-window N” flag widens the search (default 10 steps); given
+// along with a key name instead of “-sync”, it prints the codes for the N
+// time steps on either side of the current one, which is useful when
+// syncing by hand.
+//
+// By default the keychain is stored unencrypted in the text file
+// $HOME/.2fa. Running “2fa -encrypt” converts it in place to an
+// encrypted keychain protected by a passphrase, which 2fa will then
+// prompt for on stderr whenever it needs to read or update the
+// keychain. To avoid prompting (for example from a script), set
+// 2FA_PASSPHRASE_FD to the number of an already-open file descriptor
+// to read the passphrase from.
+//
+// The keychain bytes can also be kept somewhere other than that file by
+// setting 2FA_BACKEND to "keychain" (macOS Keychain), "wincred" (Windows
+// Credential Manager), "secret-service" (GNOME Keyring / KWallet via
+// D-Bus), or "pass" (the pass(1) password store); the default, "file",
+// is the plain $HOME/.2fa file described above.
 //
 // Example
 //
@@ -66,11 +104,13 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base32"
 	"encoding/binary"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash"
 	"log"
 	"os"
 	"path/filepath"
@@ -84,19 +124,30 @@ import (
 )
 
 var (
-	flagAdd  = flag.Bool("add", false, "add a key")
-	flagList = flag.Bool("list", false, "list keys")
-	flagHotp = flag.Bool("hotp", false, "add key as HOTP (counter-based) key")
-	flag7    = flag.Bool("7", false, "generate 7-digit code")
-	flag8    = flag.Bool("8", false, "generate 8-digit code")
-	flagClip = flag.Bool("clip", false, "copy code to the clipboard")
+	flagAdd     = flag.Bool("add", false, "add a key")
+	flagList    = flag.Bool("list", false, "list keys")
+	flagHotp    = flag.Bool("hotp", false, "add key as HOTP (counter-based) key")
+	flag7       = flag.Bool("7", false, "generate 7-digit code")
+	flag8       = flag.Bool("8", false, "generate 8-digit code")
+	flagClip    = flag.Bool("clip", false, "copy code to the clipboard")
+	flagEncrypt = flag.Bool("encrypt", false, "encrypt the keychain with a passphrase")
+	flagQR      = flag.String("qr", "", "read otpauth:// URI from a QR code image, for -add")
+	flagExport  = flag.Bool("export", false, "print an otpauth:// URI for a key")
+	flagAlg     = flag.String("alg", "", "HMAC algorithm for new key: SHA1 (default), SHA256, or SHA512")
+	flagPeriod  = flag.Int("period", 0, "TOTP time step in seconds for new key (default 30)")
+	flagSync    = flag.Bool("sync", false, "sync a time-based key's clock drift against a code from the server")
+	flagWindow  = flag.Int("window", 0, "show codes N time steps on either side of the current one (with -sync, search radius; default 10)")
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage:\n")
-	fmt.Fprintf(os.Stderr, "\t2fa -add [-7] [-8] [-hotp] keyname\n")
+	fmt.Fprintf(os.Stderr, "\t2fa -add [-7] [-8] [-hotp] [-alg SHA1|SHA256|SHA512] [-period N] keyname\n")
+	fmt.Fprintf(os.Stderr, "\t2fa -add -qr file [keyname]\n")
+	fmt.Fprintf(os.Stderr, "\t2fa -export keyname\n")
+	fmt.Fprintf(os.Stderr, "\t2fa -sync [-window N] keyname\n")
 	fmt.Fprintf(os.Stderr, "\t2fa -list\n")
-	fmt.Fprintf(os.Stderr, "\t2fa [-clip] keyname\n")
+	fmt.Fprintf(os.Stderr, "\t2fa -encrypt\n")
+	fmt.Fprintf(os.Stderr, "\t2fa [-clip] [-window N] keyname\n")
 	os.Exit(2)
 }
 
@@ -108,6 +159,13 @@ func main() {
 
 	k := readKeychain(filepath.Join(os.Getenv("HOME"), ".2fa"))
 
+	if *flagEncrypt {
+		if flag.NArg() != 0 || *flagList || *flagAdd || *flagClip {
+			usage()
+		}
+		k.encrypt()
+		return
+	}
 	if *flagList {
 		if flag.NArg() != 0 {
 			usage()
@@ -115,10 +173,29 @@ func main() {
 		k.list()
 		return
 	}
-	if flag.NArg() == 0 && !*flagAdd {
+	if *flagAdd {
 		if *flagClip {
 			usage()
 		}
+		var name string
+		switch {
+		case flag.NArg() == 1:
+			name = flag.Arg(0)
+		case flag.NArg() == 0 && *flagQR != "":
+			// name comes from the otpauth URI in the QR code
+		default:
+			usage()
+		}
+		if strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+			log.Fatal("name must not contain spaces")
+		}
+		k.add(name)
+		return
+	}
+	if flag.NArg() == 0 {
+		if *flagClip || *flagExport || *flagSync {
+			usage()
+		}
 		k.showAll()
 		return
 	}
@@ -129,42 +206,119 @@ func main() {
 	if strings.IndexFunc(name, unicode.IsSpace) >= 0 {
 		log.Fatal("name must not contain spaces")
 	}
-	if *flagAdd {
+	if *flagExport {
+		if *flagClip || *flagSync {
+			usage()
+		}
+		k.export(name)
+		return
+	}
+	if *flagSync {
 		if *flagClip {
 			usage()
 		}
-		k.add(name)
+		k.sync(name)
 		return
 	}
+	if *flagClip && *flagWindow > 0 {
+		usage()
+	}
 	k.show(name)
 }
 
 type Keychain struct {
-	file string
-	data []byte
-	keys map[string]Key
+	file       string
+	backend    Backend
+	data       []byte
+	keys       map[string]Key
+	encrypted  bool
+	passphrase []byte // cached, only set when encrypted
 }
 
 type Key struct {
-	raw    []byte
-	digits int
-	offset int // offset of counter
+	raw       []byte
+	digits    int
+	offset    int    // offset of counter
+	alg       string // "SHA1", "SHA256", or "SHA512"
+	period    int    // TOTP step, in seconds
+	drift     int    // clock drift, in steps, set by -sync
+	lineStart int    // offset of the key's line in c.data
+	lineEnd   int    // offset just past the key's line in c.data, including any trailing newline
 }
 
 const counterLen = 20
 
+// defaultAlg and defaultPeriod are the values assumed for keys whose
+// keychain line does not specify an algorithm or period, preserving the
+// behavior of keychains written before those fields existed.
+const (
+	defaultAlg    = "SHA1"
+	defaultPeriod = 30
+)
+
+func isAlgName(s []byte) bool {
+	switch string(s) {
+	case "SHA1", "SHA256", "SHA512":
+		return true
+	}
+	return false
+}
+
+// newHash returns the hash.Hash constructor named by alg, one of "SHA1",
+// "SHA256", or "SHA512".
+func newHash(alg string) func() hash.Hash {
+	switch alg {
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	default:
+		return sha1.New
+	}
+}
+
+func allDigits(s []byte) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, b := range s {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isSignedInt reports whether s is a leading-sign integer like "+5" or
+// "-3", the format used to persist a key's clock-drift offset. The sign
+// distinguishes it from a period field, which is never signed.
+func isSignedInt(s []byte) bool {
+	return len(s) > 1 && (s[0] == '+' || s[0] == '-') && allDigits(s[1:])
+}
+
 func readKeychain(file string) *Keychain {
 	c := &Keychain{
-		file: file,
-		keys: make(map[string]Key),
+		file:    file,
+		backend: newBackend(file),
+		keys:    make(map[string]Key),
 	}
-	data, err := ioutil.ReadFile(file)
+	data, err := c.backend.Load()
 	if err != nil {
-		if os.IsNotExist(err) {
+		if err == errNotExist {
 			return c
 		}
 		log.Fatal(err)
 	}
+
+	if bytes.HasPrefix(data, magic) {
+		c.encrypted = true
+		c.passphrase = getPassphrase(false)
+		plain, err := decryptKeychain(data, c.passphrase)
+		if err != nil {
+			log.Fatalf("decrypting keychain: %v", err)
+		}
+		data = plain
+	}
 	c.data = data
 
 	lines := bytes.SplitAfter(data, []byte("\n"))
@@ -180,24 +334,50 @@ func readKeychain(file string) *Keychain {
 			var k Key
 			name := string(f[0])
 			k.digits = int(f[1][0] - '0')
+			k.alg = defaultAlg
+			k.period = defaultPeriod
+			k.lineStart = offset - len(line)
+			k.lineEnd = offset
 			raw, err := decodeKey(string(f[2]))
 			if err == nil {
 				k.raw = raw
-				if len(f) == 3 {
-					c.keys[name] = k
-					continue
-				}
-				if len(f) == 4 && len(f[3]) == counterLen {
-					_, err := strconv.ParseUint(string(f[3]), 10, 64)
-					if err == nil {
-						// Valid counter.
-						k.offset = offset - counterLen
-						if line[len(line)-1] == '\n' {
-							k.offset--
+				ok := true
+				// cursor tracks the byte offset, within data, of the
+				// start of each remaining field, so a counter field
+				// need not be the last one on the line.
+				cursor := offset - len(line) + len(f[0]) + 1 + len(f[1]) + 1 + len(f[2]) + 1
+				for _, extra := range f[3:] {
+					switch {
+					case len(extra) == counterLen && allDigits(extra):
+						if _, err := strconv.ParseUint(string(extra), 10, 64); err != nil {
+							ok = false
+							break
+						}
+						k.offset = cursor
+					case isAlgName(extra):
+						k.alg = string(extra)
+					case isSignedInt(extra):
+						n, err := strconv.Atoi(string(extra))
+						if err != nil {
+							ok = false
+							break
+						}
+						k.drift = n
+					case allDigits(extra):
+						n, err := strconv.Atoi(string(extra))
+						if err != nil || n <= 0 {
+							ok = false
+							break
 						}
-						c.keys[name] = k
-						continue
+						k.period = n
+					default:
+						ok = false
 					}
+					cursor += len(extra) + 1
+				}
+				if ok {
+					c.keys[name] = k
+					continue
 				}
 			}
 		}
@@ -206,6 +386,123 @@ func readKeychain(file string) *Keychain {
 	return c
 }
 
+// saveKeychain writes c.data back through c.backend, encrypting it first
+// if the keychain is encrypted.
+func (c *Keychain) saveKeychain() {
+	out := c.data
+	if c.encrypted {
+		enc, err := encryptKeychain(c.data, c.passphrase)
+		if err != nil {
+			log.Fatalf("encrypting keychain: %v", err)
+		}
+		out = enc
+	}
+	if err := c.backend.Save(out); err != nil {
+		log.Fatalf("saving keychain: %v", err)
+	}
+}
+
+// replaceLine replaces the on-disk line for name with newLine, splicing
+// c.data and shifting the recorded offsets of every other key whose line
+// comes after it. It does not save the keychain; callers do that once
+// they've also updated the in-memory Key.
+func (c *Keychain) replaceLine(name, newLine string) {
+	k := c.keys[name]
+	oldEnd := k.lineEnd
+	delta := len(newLine) - (oldEnd - k.lineStart)
+
+	data := make([]byte, 0, len(c.data)+delta)
+	data = append(data, c.data[:k.lineStart]...)
+	data = append(data, newLine...)
+	data = append(data, c.data[oldEnd:]...)
+	c.data = data
+
+	k.lineEnd += delta
+	c.keys[name] = k
+
+	for other, v := range c.keys {
+		if other == name || v.lineStart < oldEnd {
+			continue
+		}
+		v.lineStart += delta
+		v.lineEnd += delta
+		if v.offset != 0 {
+			v.offset += delta
+		}
+		c.keys[other] = v
+	}
+}
+
+// setDrift persists drift as the clock-drift offset, in time steps, for
+// the time-based key name.
+func (c *Keychain) setDrift(name string, drift int) {
+	k := c.keys[name]
+	line := fmt.Sprintf("%s %d %s", name, k.digits, base32.StdEncoding.EncodeToString(k.raw))
+	if k.alg != defaultAlg {
+		line += " " + k.alg
+	}
+	if k.period != defaultPeriod {
+		line += " " + strconv.Itoa(k.period)
+	}
+	if drift != 0 {
+		line += fmt.Sprintf(" %+d", drift)
+	}
+	line += "\n"
+
+	c.replaceLine(name, line)
+	k = c.keys[name]
+	k.drift = drift
+	c.keys[name] = k
+	c.saveKeychain()
+}
+
+// sync fixes clock drift for the time-based key name: it prompts for a
+// currently valid code from the server and searches nearby time steps for
+// one that matches, storing the resulting offset in the keychain.
+func (c *Keychain) sync(name string) {
+	k, ok := c.keys[name]
+	if !ok {
+		log.Fatalf("no such key %q", name)
+	}
+	if k.offset != 0 {
+		log.Fatalf("%s is a counter-based (HOTP) key; only time-based keys can be synced", name)
+	}
+
+	window := 10
+	if *flagWindow > 0 {
+		window = *flagWindow
+	}
+
+	fmt.Fprintf(os.Stderr, "2fa code for %s: ", name)
+	text, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatalf("error reading code: %v", err)
+	}
+	text = strings.TrimSpace(text)
+
+	base := timeStep(time.Now(), k.period)
+	alg := newHash(k.alg)
+	for d := -window; d <= window; d++ {
+		code := hotp(k.raw, uint64(base+int64(d)), k.digits, alg)
+		if fmt.Sprintf("%0*d", k.digits, code) == text {
+			c.setDrift(name, d)
+			fmt.Fprintf(os.Stderr, "synced %s (%+d step offset)\n", name, d)
+			return
+		}
+	}
+	log.Fatalf("no matching code for %s within %d steps of now", name, window)
+}
+
+// encrypt converts the keychain to the encrypted on-disk format,
+// prompting for a new passphrase (unless one is already cached).
+func (c *Keychain) encrypt() {
+	if !c.encrypted {
+		c.passphrase = getPassphrase(true)
+		c.encrypted = true
+	}
+	c.saveKeychain()
+}
+
 func (c *Keychain) list() {
 	var names []string
 	for name := range c.keys {
@@ -235,35 +532,89 @@ func (c *Keychain) add(name string) {
 		size = 8
 	}
 
-	fmt.Fprintf(os.Stderr, "2fa key for %s: ", name)
-	text, err := bufio.NewReader(os.Stdin).ReadString('\n')
-	if err != nil {
-		log.Fatalf("error reading key: %v", err)
+	var text string
+	if *flagQR != "" {
+		uri, err := decodeQRFile(*flagQR)
+		if err != nil {
+			log.Fatalf("reading QR code: %v", err)
+		}
+		text = uri
+	} else {
+		fmt.Fprintf(os.Stderr, "2fa key for %s: ", name)
+		t, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			log.Fatalf("error reading key: %v", err)
+		}
+		text = strings.TrimSpace(t)
 	}
+
+	if strings.HasPrefix(text, "otpauth://") {
+		o, err := parseOtpauthURI(text)
+		if err != nil {
+			log.Fatalf("parsing otpauth URI: %v", err)
+		}
+		if name != "" {
+			o.name = name
+		}
+		if strings.IndexFunc(o.name, unicode.IsSpace) >= 0 {
+			log.Fatalf("otpauth URI account name %q must not contain spaces", o.name)
+		}
+		c.data = append(c.data, o.line()...)
+		c.saveKeychain()
+		return
+	}
+	if *flagQR != "" {
+		log.Fatalf("QR code does not contain an otpauth:// URI")
+	}
+	if name == "" {
+		log.Fatal("no name given")
+	}
+
 	text = strings.Map(noSpace, text)
 	text += strings.Repeat("=", -len(text)&7) // pad to 8 bytes
 	if _, err := decodeKey(text); err != nil {
 		log.Fatalf("invalid key: %v", err)
 	}
 
+	alg := defaultAlg
+	if *flagAlg != "" {
+		alg = strings.ToUpper(*flagAlg)
+		if !isAlgName([]byte(alg)) {
+			log.Fatalf("unsupported -alg %q", *flagAlg)
+		}
+	}
+	period := defaultPeriod
+	if *flagPeriod != 0 {
+		if *flagPeriod < 0 {
+			log.Fatalf("-period must be positive")
+		}
+		period = *flagPeriod
+	}
+
 	line := fmt.Sprintf("%s %d %s", name, size, text)
+	if alg != defaultAlg {
+		line += " " + alg
+	}
+	if period != defaultPeriod {
+		line += " " + strconv.Itoa(period)
+	}
 	if *flagHotp {
 		line += " " + strings.Repeat("0", 20)
 	}
 	line += "\n"
 
-	f, err := os.OpenFile(c.file, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
-	if err != nil {
-		log.Fatalf("opening keychain: %v", err)
-	}
-	f.Chmod(0600)
+	c.data = append(c.data, line...)
+	c.saveKeychain()
+}
 
-	if _, err := f.Write([]byte(line)); err != nil {
-		log.Fatalf("adding key: %v", err)
-	}
-	if err := f.Close(); err != nil {
-		log.Fatalf("adding key: %v", err)
+// export prints an otpauth:// URI for name, the inverse of the otpauth
+// import supported by add.
+func (c *Keychain) export(name string) {
+	k, ok := c.keys[name]
+	if !ok {
+		log.Fatalf("no such key %q", name)
 	}
+	fmt.Println(c.otpauthURI(name, k))
 }
 
 func (c *Keychain) code(name string) string {
@@ -278,25 +629,40 @@ func (c *Keychain) code(name string) string {
 			log.Fatalf("malformed key counter for %q (%q)", name, c.data[k.offset:k.offset+counterLen])
 		}
 		n++
-		code = hotp(k.raw, n, k.digits)
-		f, err := os.OpenFile(c.file, os.O_RDWR, 0600)
-		if err != nil {
-			log.Fatalf("opening keychain: %v", err)
-		}
-		if _, err := f.WriteAt([]byte(fmt.Sprintf("%0*d", counterLen, n)), int64(k.offset)); err != nil {
-			log.Fatalf("updating keychain: %v", err)
-		}
-		if err := f.Close(); err != nil {
-			log.Fatalf("updating keychain: %v", err)
-		}
+		code = hotp(k.raw, n, k.digits, newHash(k.alg))
+		copy(c.data[k.offset:k.offset+counterLen], fmt.Sprintf("%0*d", counterLen, n))
+		c.saveKeychain()
 	} else {
 		// Time-based key.
-		code = totp(k.raw, time.Now(), k.digits)
+		code = totp(k.raw, time.Now(), k.digits, newHash(k.alg), k.period, k.drift)
 	}
 	return fmt.Sprintf("%0*d", k.digits, code)
 }
 
+// codeWindow returns the codes for the 2*window+1 time steps centered on
+// now for the time-based key name, oldest first. It is used to print a
+// spread of codes for a clock that may have drifted, or to sync one by
+// hand against the output of 2fa on another machine.
+func (c *Keychain) codeWindow(name string, window int) []string {
+	k, ok := c.keys[name]
+	if !ok {
+		log.Fatalf("no such key %q", name)
+	}
+	base := timeStep(time.Now(), k.period) + int64(k.drift)
+	alg := newHash(k.alg)
+	var codes []string
+	for d := -window; d <= window; d++ {
+		code := hotp(k.raw, uint64(base+int64(d)), k.digits, alg)
+		codes = append(codes, fmt.Sprintf("%0*d", k.digits, code))
+	}
+	return codes
+}
+
 func (c *Keychain) show(name string) {
+	if *flagWindow > 0 && c.keys[name].offset == 0 {
+		fmt.Println(strings.Join(c.codeWindow(name, *flagWindow), " "))
+		return
+	}
 	code := c.code(name)
 	if *flagClip {
 		clipboard.WriteAll(code)
@@ -317,7 +683,12 @@ func (c *Keychain) showAll() {
 	for _, name := range names {
 		k := c.keys[name]
 		code := strings.Repeat("-", k.digits)
-		if k.offset == 0 {
+		switch {
+		case k.offset != 0:
+			// Counter-based key: printing a code would consume it.
+		case *flagWindow > 0:
+			code = strings.Join(c.codeWindow(name, *flagWindow), " ")
+		default:
 			code = c.code(name)
 		}
 		fmt.Printf("%-*s\t%s\n", max, code, name)
@@ -328,8 +699,8 @@ func decodeKey(key string) ([]byte, error) {
 	return base32.StdEncoding.DecodeString(strings.ToUpper(key))
 }
 
-func hotp(key []byte, counter uint64, digits int) int {
-	h := hmac.New(sha1.New, key)
+func hotp(key []byte, counter uint64, digits int, alg func() hash.Hash) int {
+	h := hmac.New(alg, key)
 	binary.Write(h, binary.BigEndian, counter)
 	sum := h.Sum(nil)
 	v := binary.BigEndian.Uint32(sum[sum[len(sum)-1]&0x0F:]) & 0x7FFFFFFF
@@ -340,6 +711,12 @@ func hotp(key []byte, counter uint64, digits int) int {
 	return int(v % d)
 }
 
-func totp(key []byte, t time.Time, digits int) int {
-	return hotp(key, uint64(t.UnixNano())/30e9, digits)
+// timeStep returns the TOTP time-step counter for t, given a period in seconds.
+func timeStep(t time.Time, period int) int64 {
+	return int64(uint64(t.UnixNano()) / (uint64(period) * 1e9))
+}
+
+func totp(key []byte, t time.Time, digits int, alg func() hash.Hash, period, drift int) int {
+	counter := timeStep(t, period) + int64(drift)
+	return hotp(key, uint64(counter), digits, alg)
 }
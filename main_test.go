@@ -0,0 +1,131 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCodeWindowUnknownKeyDoesNotPanic is a regression test: codeWindow
+// used to divide by k.period before checking that the key existed, so an
+// unknown name crashed the whole process instead of reporting a clean
+// "no such key" error. It must log.Fatalf (exit 1), not panic (exit 2
+// with a stack trace), so this runs the call in a subprocess.
+func TestCodeWindowUnknownKeyDoesNotPanic(t *testing.T) {
+	if os.Getenv("CODEWINDOW_CRASHER") == "1" {
+		c := &Keychain{keys: map[string]Key{}}
+		c.codeWindow("nope", 1)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestCodeWindowUnknownKeyDoesNotPanic")
+	cmd.Env = append(os.Environ(), "CODEWINDOW_CRASHER=1")
+	out, err := cmd.CombinedOutput()
+
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("codeWindow on unknown key exited with %v, want a clean non-zero exit; output:\n%s", err, out)
+	}
+	if ee.ExitCode() != 1 {
+		t.Fatalf("codeWindow on unknown key exit code = %d, want 1 (log.Fatalf, not a panic); output:\n%s", ee.ExitCode(), out)
+	}
+	if strings.Contains(string(out), "panic:") {
+		t.Fatalf("codeWindow on unknown key panicked instead of calling log.Fatalf; output:\n%s", out)
+	}
+}
+
+// TestReplaceLineShiftsLaterOffsets covers replaceLine's offset-shifting
+// math: rewriting one key's line must keep every later key's recorded
+// lineStart/lineEnd/offset pointing at the right bytes in c.data, even
+// though the rewritten line changes length.
+func TestReplaceLineShiftsLaterOffsets(t *testing.T) {
+	// alice is a plain TOTP key; bob is an HOTP key whose stored counter
+	// field (Key.offset) must still resolve correctly in c.data after
+	// alice's line grows.
+	c := writeKeychain(t,
+		"alice 6 "+rfc4226Secret+"\n",
+		// The stored counter is the last one used (see otpauth.go's
+		// line method); 18446744073709551615 is -1 wrapped to uint64,
+		// so the first code handed out is for counter 0.
+		"bob 6 "+rfc4226Secret+" 18446744073709551615\n",
+	)
+	bobBefore, ok := c.keys["bob"]
+	if !ok {
+		t.Fatal("readKeychain did not recover bob")
+	}
+
+	// setDrift rewrites alice's line, growing it by appending " +5".
+	c.setDrift("alice", 5)
+
+	bobAfter, ok := c.keys["bob"]
+	if !ok {
+		t.Fatal("bob disappeared from the keychain after alice's line was rewritten")
+	}
+	delta := bobAfter.lineStart - bobBefore.lineStart
+	if delta <= 0 {
+		t.Fatalf("bob.lineStart did not shift forward after alice's line grew (before %d, after %d)", bobBefore.lineStart, bobAfter.lineStart)
+	}
+	if bobAfter.lineEnd-bobAfter.lineStart != bobBefore.lineEnd-bobBefore.lineStart {
+		t.Fatalf("bob's line length changed; want it untouched, got %d bytes, was %d", bobAfter.lineEnd-bobAfter.lineStart, bobBefore.lineEnd-bobBefore.lineStart)
+	}
+	if bobAfter.offset-bobBefore.offset != delta {
+		t.Fatalf("bob.offset shifted by %d, want %d (same as lineStart)", bobAfter.offset-bobBefore.offset, delta)
+	}
+
+	// The shifted offset must still point at bob's counter field: the
+	// first code handed out should be the RFC 4226 counter=0 vector.
+	if got := c.code("bob"); got != "755224" {
+		t.Fatalf("code(bob) after alice's line grew = %s, want 755224", got)
+	}
+}
+
+// TestSetDriftRoundTrip checks that the drift stored by setDrift survives
+// being written out and the keychain read back in.
+func TestSetDriftRoundTrip(t *testing.T) {
+	c := writeKeychain(t, "alice 6 "+rfc4226Secret+"\n")
+	c.setDrift("alice", -3)
+
+	c2 := readKeychain(c.file)
+	k, ok := c2.keys["alice"]
+	if !ok {
+		t.Fatal("readKeychain did not recover alice after setDrift")
+	}
+	if k.drift != -3 {
+		t.Fatalf("drift after round trip = %d, want -3", k.drift)
+	}
+}
+
+// TestSync feeds sync a code from a few steps in the future and checks
+// that it stores the matching drift.
+func TestSync(t *testing.T) {
+	c := writeKeychain(t, "alice 6 "+rfc4226Secret+"\n")
+	k := c.keys["alice"]
+
+	const stepsAhead = 3
+	future := time.Now().Add(time.Duration(stepsAhead*k.period) * time.Second)
+	code := totp(k.raw, future, k.digits, newHash(k.alg), k.period, 0)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(w, "%0*d\n", k.digits, code)
+	w.Close()
+
+	oldStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = oldStdin }()
+
+	c.sync("alice")
+
+	if got := c.keys["alice"].drift; got != stepsAhead {
+		t.Fatalf("drift after sync = %d, want %d", got, stepsAhead)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base32"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// otpImport holds the fields carried by an otpauth:// enrollment URI, the
+// format used by essentially every site's 2FA setup QR code.
+type otpImport struct {
+	name    string
+	secret  []byte
+	digits  int
+	alg     string
+	period  int
+	hotp    bool
+	counter uint64
+}
+
+// parseOtpauthURI parses raw as an otpauth://totp/... or otpauth://hotp/...
+// URI, as documented at
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func parseOtpauthURI(raw string) (*otpImport, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "otpauth" {
+		return nil, fmt.Errorf("not an otpauth:// URI")
+	}
+
+	var o otpImport
+	switch u.Host {
+	case "totp":
+		o.hotp = false
+	case "hotp":
+		o.hotp = true
+	default:
+		return nil, fmt.Errorf("unsupported otpauth type %q", u.Host)
+	}
+
+	label := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(label, ":"); i >= 0 {
+		// Label is "Issuer:accountname"; 2fa keys are just a name.
+		label = label[i+1:]
+	}
+	o.name = label
+	if o.name == "" {
+		return nil, fmt.Errorf("otpauth URI missing account name")
+	}
+
+	q := u.Query()
+
+	secret := q.Get("secret")
+	if secret == "" {
+		return nil, fmt.Errorf("otpauth URI missing secret")
+	}
+	secret = strings.ToUpper(secret)
+	secret += strings.Repeat("=", -len(secret)&7)
+	raw2, err := decodeKey(secret)
+	if err != nil {
+		return nil, fmt.Errorf("otpauth URI has invalid secret: %v", err)
+	}
+	o.secret = raw2
+
+	o.digits = 6
+	if v := q.Get("digits"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 6 || n > 8 {
+			return nil, fmt.Errorf("otpauth URI has unsupported digits %q (want 6, 7, or 8)", v)
+		}
+		o.digits = n
+	}
+
+	o.alg = defaultAlg
+	if v := strings.ToUpper(q.Get("algorithm")); v != "" {
+		if !isAlgName([]byte(v)) {
+			return nil, fmt.Errorf("otpauth URI has unsupported algorithm %q", v)
+		}
+		o.alg = v
+	}
+
+	o.period = defaultPeriod
+	if v := q.Get("period"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("otpauth URI has invalid period %q", v)
+		}
+		o.period = n
+	}
+
+	if o.hotp {
+		v := q.Get("counter")
+		if v == "" {
+			return nil, fmt.Errorf("otpauth URI missing counter for hotp key")
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("otpauth URI has invalid counter: %v", err)
+		}
+		o.counter = n
+	}
+	return &o, nil
+}
+
+// line renders o as a 2fa keychain line, in the format readKeychain parses.
+func (o *otpImport) line() string {
+	text := base32.StdEncoding.EncodeToString(o.secret)
+	line := fmt.Sprintf("%s %d %s", o.name, o.digits, text)
+	if o.alg != defaultAlg {
+		line += " " + o.alg
+	}
+	if o.period != defaultPeriod {
+		line += " " + strconv.Itoa(o.period)
+	}
+	if o.hotp {
+		// The stored field is the last counter value used, as in code();
+		// the first code handed out after import must be for o.counter
+		// itself, so store o.counter-1. For o.counter==0 this subtracts
+		// into a uint64 that wraps around to its maximum value,
+		// 18446744073709551615, which code()'s
+		// own n++ then wraps back around to 0 — giving the right first
+		// code without a signed or "unset" sentinel.
+		line += " " + fmt.Sprintf("%0*d", counterLen, o.counter-1)
+	}
+	return line + "\n"
+}
+
+// otpauthURI renders k, named name, as an otpauth:// URI suitable for
+// another authenticator app or 2fa keychain to import.
+func (c *Keychain) otpauthURI(name string, k Key) string {
+	v := url.Values{}
+	v.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(k.raw))
+	v.Set("digits", strconv.Itoa(k.digits))
+	if k.alg != defaultAlg {
+		v.Set("algorithm", k.alg)
+	}
+
+	typ := "totp"
+	if k.offset != 0 {
+		typ = "hotp"
+		n, err := strconv.ParseUint(string(c.data[k.offset:k.offset+counterLen]), 10, 64)
+		if err != nil {
+			log.Fatalf("malformed key counter for %q (%q)", name, c.data[k.offset:k.offset+counterLen])
+		}
+		v.Set("counter", strconv.FormatUint(n+1, 10))
+	} else if k.period != defaultPeriod {
+		v.Set("period", strconv.Itoa(k.period))
+	}
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     typ,
+		Path:     "/" + name,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
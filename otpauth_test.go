@@ -0,0 +1,137 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rfc4226Secret is the 20-byte ASCII secret used by the RFC 4226/6238 test
+// vectors, base32-encoded as an otpauth:// URI would carry it.
+const rfc4226Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// writeKeychain writes lines to a fresh keychain file in a temp dir and
+// reads it back, the same path add() and readKeychain() exercise together.
+func writeKeychain(t *testing.T, lines ...string) *Keychain {
+	t.Helper()
+	dir := t.TempDir()
+	file := filepath.Join(dir, ".2fa")
+	var data string
+	for _, line := range lines {
+		data += line
+	}
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return readKeychain(file)
+}
+
+func TestOtpauthImportExportRoundTrip(t *testing.T) {
+	uri := "otpauth://totp/Example:alice@example.com?secret=" + rfc4226Secret +
+		"&issuer=Example&algorithm=SHA256&period=45&digits=8"
+
+	o, err := parseOtpauthURI(uri)
+	if err != nil {
+		t.Fatalf("parseOtpauthURI: %v", err)
+	}
+	if o.name != "alice@example.com" || o.alg != "SHA256" || o.period != 45 || o.digits != 8 {
+		t.Fatalf("parsed otpImport = %+v, want name alice@example.com, SHA256, period 45, digits 8", o)
+	}
+
+	c := writeKeychain(t, o.line())
+	k, ok := c.keys["alice@example.com"]
+	if !ok {
+		t.Fatalf("readKeychain did not recover the imported key; line was %q", o.line())
+	}
+	if k.digits != 8 || k.alg != "SHA256" || k.period != 45 {
+		t.Fatalf("recovered Key = %+v, want digits 8, SHA256, period 45", k)
+	}
+
+	// otpauthURI should reconstruct an equivalent URI for re-export.
+	out := c.otpauthURI("alice@example.com", k)
+	o2, err := parseOtpauthURI(out)
+	if err != nil {
+		t.Fatalf("round-tripped URI %q did not parse: %v", out, err)
+	}
+	if o2.digits != 8 || o2.alg != "SHA256" || o2.period != 45 {
+		t.Fatalf("round-tripped otpImport = %+v, want digits 8, SHA256, period 45", o2)
+	}
+}
+
+func TestOtpauthImportTOTPCode(t *testing.T) {
+	uri := "otpauth://totp/rfc6238?secret=" + rfc4226Secret
+	o, err := parseOtpauthURI(uri)
+	if err != nil {
+		t.Fatalf("parseOtpauthURI: %v", err)
+	}
+	c := writeKeychain(t, o.line())
+	k, ok := c.keys["rfc6238"]
+	if !ok {
+		t.Fatal("readKeychain did not recover the imported key")
+	}
+
+	// RFC 6238 test vector: T=59s, 30s step, SHA1 -> 94287082; low 6 digits 287082.
+	code := totp(k.raw, time.Unix(59, 0), k.digits, newHash(k.alg), k.period, k.drift)
+	if got := fmt.Sprintf("%0*d", k.digits, code); got != "287082" {
+		t.Fatalf("totp at T=59 = %s, want 287082", got)
+	}
+}
+
+// TestOtpauthImportHOTPFirstCode is a regression test for the stored-counter
+// off-by-one: the first code handed out after importing counter=0 must be
+// the counter=0 code, not counter=1.
+func TestOtpauthImportHOTPFirstCode(t *testing.T) {
+	uri := "otpauth://hotp/rfc4226?secret=" + rfc4226Secret + "&counter=0"
+	o, err := parseOtpauthURI(uri)
+	if err != nil {
+		t.Fatalf("parseOtpauthURI: %v", err)
+	}
+	c := writeKeychain(t, o.line())
+	if _, ok := c.keys["rfc4226"]; !ok {
+		t.Fatalf("readKeychain did not recover the imported key; line was %q", o.line())
+	}
+
+	// RFC 4226 test vector: counter 0 -> 755224.
+	if got := c.code("rfc4226"); got != "755224" {
+		t.Fatalf("first code = %s, want 755224 (RFC 4226 counter=0)", got)
+	}
+	// The second code should then be the counter=1 vector.
+	if got := c.code("rfc4226"); got != "287082" {
+		t.Fatalf("second code = %s, want 287082 (RFC 4226 counter=1)", got)
+	}
+}
+
+func TestParseOtpauthURIRejectsBadDigits(t *testing.T) {
+	for _, digits := range []string{"4", "10", "abc"} {
+		uri := "otpauth://totp/acct?secret=" + rfc4226Secret + "&digits=" + digits
+		if _, err := parseOtpauthURI(uri); err == nil {
+			t.Errorf("parseOtpauthURI with digits=%s: got no error, want rejection", digits)
+		}
+	}
+}
+
+// TestReadKeychainRejectsBadPeriod is a regression test: a keychain line
+// with a zero period (as could be hand-edited or written by some other
+// tool) must be treated as malformed at read time, not let through to
+// crash later in timeStep's division.
+func TestReadKeychainRejectsBadPeriod(t *testing.T) {
+	c := writeKeychain(t, "broken 6 "+rfc4226Secret+" 0\n")
+	if _, ok := c.keys["broken"]; ok {
+		t.Fatal("readKeychain accepted a key with period 0, want it rejected as malformed")
+	}
+}
+
+func TestParseOtpauthURIRejectsBadPeriod(t *testing.T) {
+	for _, period := range []string{"0", "-5", "abc"} {
+		uri := "otpauth://totp/acct?secret=" + rfc4226Secret + "&period=" + period
+		if _, err := parseOtpauthURI(uri); err == nil {
+			t.Errorf("parseOtpauthURI with period=%s: got no error, want rejection", period)
+		}
+	}
+}